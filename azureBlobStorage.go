@@ -1,21 +1,73 @@
 package certmagic_azure
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+// AuthMode selects how the module authenticates against Azure Blob Storage.
+type AuthMode string
+
+const (
+	AuthModeSharedKey        AuthMode = "shared_key"
+	AuthModeConnectionString AuthMode = "connection_string"
+	AuthModeDefault          AuthMode = "default"
+	AuthModeManagedIdentity  AuthMode = "managed_identity"
+	AuthModeWorkloadIdentity AuthMode = "workload_identity"
+	AuthModeClientSecret     AuthMode = "client_secret"
+	AuthModeSAS              AuthMode = "sas"
+)
+
+// lockLeaseDuration is the duration of the blob lease backing a lock. It is
+// renewed well before expiry so that a live holder never loses it, while a
+// crashed holder's lock still expires and can be reclaimed.
+const lockLeaseDuration = 60 * time.Second
+
+// lockRenewInterval is how often a held lock's lease is renewed.
+const lockRenewInterval = 30 * time.Second
+
+// defaultUploadBlockSize and defaultUploadConcurrency are the UploadStream
+// defaults used when upload_block_size/upload_concurrency aren't configured.
+const (
+	defaultUploadBlockSize   = 4 * 1024 * 1024
+	defaultUploadConcurrency = 4
+)
+
+// activeLock tracks the state needed to renew and release a held blob lease.
+type activeLock struct {
+	leaseID string
+	cancel  context.CancelFunc
+}
+
 type AzureBlob struct {
 	logger *zap.Logger
 
@@ -25,6 +77,34 @@ type AzureBlob struct {
 	Container   string `json:"container"`
 	Prefix      string `json:"prefix"`
 	Client      *azblob.Client
+
+	// ContainerClient is the cached client for Container, built once in
+	// Provision and reused by Exists, Stat, locking and streamed uploads.
+	// Buffered uploads, Load, Delete and List go through Client.
+	ContainerClient *container.Client
+
+	// Authentication
+	AuthMode         AuthMode `json:"auth_mode,omitempty"`
+	ConnectionString string   `json:"connection_string,omitempty"`
+	ClientID         string   `json:"client_id,omitempty"`
+	TenantID         string   `json:"tenant_id,omitempty"`
+	ClientSecret     string   `json:"client_secret,omitempty"`
+	SASToken         string   `json:"sas_token,omitempty"`
+	Endpoint         string   `json:"endpoint,omitempty"`
+
+	// Encryption and storage tiering
+	EncryptionKey   string          `json:"encryption_key,omitempty"`
+	EncryptionScope string          `json:"encryption_scope,omitempty"`
+	AccessTier      blob.AccessTier `json:"access_tier,omitempty"`
+	cpkInfo         *blob.CPKInfo
+	cpkScopeInfo    *blob.CPKScopeInfo
+
+	// Upload streaming
+	UploadBlockSize   int64 `json:"upload_block_size,omitempty"`
+	UploadConcurrency int   `json:"upload_concurrency,omitempty"`
+
+	locksMu *sync.Mutex
+	locks   map[string]*activeLock
 }
 
 func init() {
@@ -50,6 +130,38 @@ func (az *AzureBlob) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			az.Container = value
 		case "prefix":
 			az.Prefix = value
+		case "auth_mode":
+			az.AuthMode = AuthMode(value)
+		case "connection_string":
+			az.ConnectionString = value
+		case "client_id":
+			az.ClientID = value
+		case "tenant_id":
+			az.TenantID = value
+		case "client_secret":
+			az.ClientSecret = value
+		case "sas_token":
+			az.SASToken = value
+		case "endpoint":
+			az.Endpoint = value
+		case "encryption_key":
+			az.EncryptionKey = value
+		case "encryption_scope":
+			az.EncryptionScope = value
+		case "access_tier":
+			az.AccessTier = blob.AccessTier(value)
+		case "upload_block_size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return d.Errf("invalid upload_block_size %q: %v", value, err)
+			}
+			az.UploadBlockSize = size
+		case "upload_concurrency":
+			concurrency, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid upload_concurrency %q: %v", value, err)
+			}
+			az.UploadConcurrency = concurrency
 		}
 	}
 
@@ -76,21 +188,192 @@ func (az *AzureBlob) Provision(ctx caddy.Context) error {
 		az.Prefix = os.Getenv("AZURE_PREFIX")
 	}
 
-	// Create Azure Blob Storage client
-	cred, err := azblob.NewSharedKeyCredential(az.AccountName, az.AccountKey)
-	if err != nil {
-		return fmt.Errorf("failed to create Azure credentials: %w", err)
+	if az.AuthMode == "" {
+		az.AuthMode = AuthMode(os.Getenv("AZURE_AUTH_MODE"))
+	}
+
+	if az.ConnectionString == "" {
+		az.ConnectionString = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+	}
+
+	if az.ClientID == "" {
+		az.ClientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+
+	if az.TenantID == "" {
+		az.TenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+
+	if az.ClientSecret == "" {
+		az.ClientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+	}
+
+	if az.SASToken == "" {
+		az.SASToken = os.Getenv("AZURE_SAS_TOKEN")
+	}
+
+	if az.Endpoint == "" {
+		az.Endpoint = os.Getenv("AZURE_ENDPOINT")
+	}
+
+	if az.EncryptionKey == "" {
+		az.EncryptionKey = os.Getenv("AZURE_ENCRYPTION_KEY")
+	}
+
+	if az.EncryptionScope == "" {
+		az.EncryptionScope = os.Getenv("AZURE_ENCRYPTION_SCOPE")
+	}
+
+	if az.AccessTier == "" {
+		az.AccessTier = blob.AccessTier(os.Getenv("AZURE_ACCESS_TIER"))
+	}
+
+	if az.UploadBlockSize == 0 {
+		az.UploadBlockSize = defaultUploadBlockSize
+	}
+
+	if az.UploadConcurrency == 0 {
+		az.UploadConcurrency = defaultUploadConcurrency
+	}
+
+	if az.EncryptionKey != "" {
+		keyBytes, err := base64.StdEncoding.DecodeString(az.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("failed to decode encryption_key as base64: %w", err)
+		}
+
+		sum := sha256.Sum256(keyBytes)
+		az.cpkInfo = &blob.CPKInfo{
+			EncryptionKey:       &az.EncryptionKey,
+			EncryptionKeySHA256: to.Ptr(base64.StdEncoding.EncodeToString(sum[:])),
+			EncryptionAlgorithm: to.Ptr(blob.EncryptionAlgorithmTypeAES256),
+		}
+	}
+
+	if az.EncryptionScope != "" {
+		az.cpkScopeInfo = &blob.CPKScopeInfo{
+			EncryptionScope: &az.EncryptionScope,
+		}
 	}
 
-	client, err := azblob.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.blob.core.windows.net", az.AccountName), cred, nil)
+	client, err := az.newClient()
 	if err != nil {
-		return fmt.Errorf("failed to create Azure Blob client: %w", err)
+		return err
 	}
 
 	az.Client = client
+	az.ContainerClient = client.ServiceClient().NewContainerClient(az.Container)
+	az.locksMu = &sync.Mutex{}
+	az.locks = make(map[string]*activeLock)
 	return nil
 }
 
+// serviceURL returns the blob service endpoint to use, defaulting to the
+// public cloud endpoint derived from AccountName unless Endpoint is set
+// (e.g. for Azurite or sovereign clouds).
+func (az *AzureBlob) serviceURL() string {
+	if az.Endpoint != "" {
+		return az.Endpoint
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net", az.AccountName)
+}
+
+// newClient builds the azblob.Client to use according to AuthMode. It mirrors
+// the auth surface of the newer azure-sdk-for-go azblob package: shared key,
+// connection string, SAS, and the various azidentity credential types.
+func (az *AzureBlob) newClient() (*azblob.Client, error) {
+	switch az.AuthMode {
+	case "", AuthModeSharedKey:
+		cred, err := azblob.NewSharedKeyCredential(az.AccountName, az.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure credentials: %w", err)
+		}
+
+		client, err := azblob.NewClientWithSharedKeyCredential(az.serviceURL(), cred, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+		}
+
+		return client, nil
+
+	case AuthModeConnectionString:
+		client, err := azblob.NewClientFromConnectionString(az.ConnectionString, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure Blob client from connection string: %w", err)
+		}
+
+		return client, nil
+
+	case AuthModeSAS:
+		client, err := azblob.NewClientWithNoCredential(az.serviceURL()+"?"+strings.TrimPrefix(az.SASToken, "?"), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure Blob client from SAS token: %w", err)
+		}
+
+		return client, nil
+
+	case AuthModeDefault, AuthModeManagedIdentity, AuthModeWorkloadIdentity, AuthModeClientSecret:
+		cred, err := az.tokenCredential()
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := azblob.NewClient(az.serviceURL(), cred, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+		}
+
+		return client, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported auth_mode: %q", az.AuthMode)
+	}
+}
+
+// tokenCredential builds the azcore.TokenCredential for the azidentity-backed
+// auth modes (default, managed identity, workload identity, client secret).
+func (az *AzureBlob) tokenCredential() (azcore.TokenCredential, error) {
+	switch az.AuthMode {
+	case AuthModeDefault:
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create default Azure credential: %w", err)
+		}
+		return cred, nil
+
+	case AuthModeManagedIdentity:
+		var opts *azidentity.ManagedIdentityCredentialOptions
+		if az.ClientID != "" {
+			opts = &azidentity.ManagedIdentityCredentialOptions{
+				ID: azidentity.ClientID(az.ClientID),
+			}
+		}
+
+		cred, err := azidentity.NewManagedIdentityCredential(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create managed identity credential: %w", err)
+		}
+		return cred, nil
+
+	case AuthModeWorkloadIdentity:
+		cred, err := azidentity.NewWorkloadIdentityCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create workload identity credential: %w", err)
+		}
+		return cred, nil
+
+	case AuthModeClientSecret:
+		cred, err := azidentity.NewClientSecretCredential(az.TenantID, az.ClientID, az.ClientSecret, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client secret credential: %w", err)
+		}
+		return cred, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported auth_mode: %q", az.AuthMode)
+	}
+}
+
 func (AzureBlob) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID: "caddy.storage.azure_blob",
@@ -104,11 +387,118 @@ func (az AzureBlob) CertMagicStorage() (certmagic.Storage, error) {
 	return az, nil
 }
 
+// lockBlobName returns the path of the marker blob backing the lock for key.
+func (az AzureBlob) lockBlobName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return az.KeyPrefix(path.Join("locks", hex.EncodeToString(sum[:])+".lock"))
+}
+
+// Lock acquires a distributed lock on key using an Azure Blob lease, so that
+// concurrent Caddy instances sharing the same container don't race on the
+// same certificate. While another holder has the lease it blocks, retrying
+// with backoff, until the lease is acquired or ctx is cancelled; any other
+// error is returned at once.
 func (az AzureBlob) Lock(ctx context.Context, key string) error {
-	return nil
+	blobName := az.lockBlobName(key)
+	blobClient := az.ContainerClient.NewBlobClient(blobName)
+
+	backoff := time.Second
+	for {
+		// Ensure the marker blob exists before we can lease it.
+		_, err := az.Client.UploadBuffer(ctx, az.Container, blobName, []byte{}, &azblob.UploadBufferOptions{
+			AccessConditions: &blob.AccessConditions{
+				ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+					IfNoneMatch: to.Ptr(azcore.ETagAny),
+				},
+			},
+		})
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobAlreadyExists) {
+			return fmt.Errorf("failed to create lock blob %q: %w", blobName, err)
+		}
+
+		leaseClient, err := lease.NewBlobClient(blobClient, &lease.BlobClientOptions{
+			LeaseID: to.Ptr(uuid.New().String()),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create lease client for %q: %w", blobName, err)
+		}
+
+		resp, err := leaseClient.AcquireLease(ctx, int32(lockLeaseDuration.Seconds()), nil)
+		if err == nil {
+			lockCtx, cancel := context.WithCancel(context.Background())
+			al := &activeLock{leaseID: *resp.LeaseID, cancel: cancel}
+
+			az.locksMu.Lock()
+			az.locks[key] = al
+			az.locksMu.Unlock()
+
+			go az.renewLock(lockCtx, leaseClient, key)
+			return nil
+		}
+
+		if bloberror.HasCode(err, bloberror.LeaseAlreadyPresent, bloberror.LeaseIDMissing) {
+			jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+			az.logger.Debug(fmt.Sprintf("Lock: %s busy, retrying in %s", key, backoff+jitter))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff + jitter):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+
+		return fmt.Errorf("failed to acquire lease for %q: %w", blobName, err)
+	}
 }
 
+// renewLock keeps a held lease alive until lockCtx is cancelled by Unlock.
+func (az AzureBlob) renewLock(lockCtx context.Context, leaseClient *lease.BlobClient, key string) {
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lockCtx.Done():
+			return
+		case <-ticker.C:
+			if _, err := leaseClient.RenewLease(lockCtx, nil); err != nil && !errors.Is(err, context.Canceled) {
+				az.logger.Error(fmt.Sprintf("failed to renew lock %s: %v", key, err))
+			}
+		}
+	}
+}
+
+// Unlock releases a lock previously acquired via Lock and stops its renewer.
 func (az AzureBlob) Unlock(ctx context.Context, key string) error {
+	az.locksMu.Lock()
+	al, ok := az.locks[key]
+	if ok {
+		delete(az.locks, key)
+	}
+	az.locksMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	al.cancel()
+
+	blobName := az.lockBlobName(key)
+	blobClient := az.ContainerClient.NewBlobClient(blobName)
+	leaseClient, err := lease.NewBlobClient(blobClient, &lease.BlobClientOptions{
+		LeaseID: &al.leaseID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create lease client for %q: %w", blobName, err)
+	}
+
+	if _, err := leaseClient.ReleaseLease(ctx, nil); err != nil {
+		return fmt.Errorf("failed to release lock %q: %w", key, err)
+	}
+
 	return nil
 }
 
@@ -116,20 +506,44 @@ func (az AzureBlob) Store(ctx context.Context, key string, value []byte) error {
 	key = az.KeyPrefix(key)
 	az.logger.Debug(fmt.Sprintf("Store: %s, %d bytes", key, len(value)))
 
-	_, err := az.Client.UploadBuffer(ctx, az.Container, key, value, nil)
+	if int64(len(value)) < az.UploadBlockSize {
+		opts := &azblob.UploadBufferOptions{
+			CPKInfo:      az.cpkInfo,
+			CPKScopeInfo: az.cpkScopeInfo,
+		}
+		if az.AccessTier != "" {
+			opts.AccessTier = &az.AccessTier
+		}
+
+		_, err := az.Client.UploadBuffer(ctx, az.Container, key, value, opts)
+		return err
+	}
+
+	opts := &blockblob.UploadStreamOptions{
+		BlockSize:    az.UploadBlockSize,
+		Concurrency:  az.UploadConcurrency,
+		CPKInfo:      az.cpkInfo,
+		CPKScopeInfo: az.cpkScopeInfo,
+	}
+	if az.AccessTier != "" {
+		opts.AccessTier = &az.AccessTier
+	}
+
+	_, err := az.ContainerClient.NewBlockBlobClient(key).UploadStream(ctx, bytes.NewReader(value), opts)
 	return err
 }
 
 func (az AzureBlob) Load(ctx context.Context, key string) ([]byte, error) {
-	if !az.Exists(ctx, key) {
-		return nil, fs.ErrNotExist
-	}
-
 	key = az.KeyPrefix(key)
 	az.logger.Debug(fmt.Sprintf("Load key: %s", key))
 
-	resp, err := az.Client.DownloadStream(ctx, az.Container, key, nil)
+	resp, err := az.Client.DownloadStream(ctx, az.Container, key, &azblob.DownloadStreamOptions{
+		CPKInfo: az.cpkInfo,
+	})
 	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, fs.ErrNotExist
+		}
 		return nil, err
 	}
 
@@ -145,32 +559,19 @@ func (az AzureBlob) Delete(ctx context.Context, key string) error {
 }
 
 func (az AzureBlob) Exists(ctx context.Context, key string) bool {
-	// Create a service client
-	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net/", az.AccountName)
-	cred, err := azblob.NewSharedKeyCredential(az.AccountName, az.AccountKey)
-	if err != nil {
-		return false
-	}
+	key = az.KeyPrefix(key)
 
-	azBlobClient, err := azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+	_, err := az.ContainerClient.NewBlobClient(key).GetProperties(ctx, &blob.GetPropertiesOptions{
+		CPKInfo: az.cpkInfo,
+	})
 	if err != nil {
+		if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			az.logger.Error(fmt.Sprintf("Exists key: %s, error: %v", key, err))
+		}
 		return false
 	}
 
-	// Get a client for the container
-	containerClient := azBlobClient.ServiceClient().NewContainerClient(az.Container)
-
-	// Get a client for the blob
-	blobClient := containerClient.NewBlobClient(key)
-
-	// Check if the blob exists
-	_, err = blobClient.GetProperties(context.Background(), nil)
-
-	if err != nil {
-		return false // Some other error occurred
-	}
-
-	return true // Blob exists
+	return true
 }
 
 func (az AzureBlob) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
@@ -199,10 +600,15 @@ func (az AzureBlob) List(ctx context.Context, prefix string, recursive bool) ([]
 func (az AzureBlob) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
 	key = az.KeyPrefix(key)
 
-	props, err := az.Client.ServiceClient().NewContainerClient(az.Container).NewBlobClient(key).GetProperties(ctx, nil)
+	props, err := az.ContainerClient.NewBlobClient(key).GetProperties(ctx, &blob.GetPropertiesOptions{
+		CPKInfo: az.cpkInfo,
+	})
 	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return certmagic.KeyInfo{}, fs.ErrNotExist
+		}
 		az.logger.Error(fmt.Sprintf("Stat key: %s, error: %v", key, err))
-		return certmagic.KeyInfo{}, nil
+		return certmagic.KeyInfo{}, err
 	}
 
 	az.logger.Debug(fmt.Sprintf("Stat key: %s, size: %d bytes", key, *props.ContentLength))